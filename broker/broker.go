@@ -5,17 +5,28 @@
 package broker
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/beanstalkd/go-beanstalk"
+	"github.com/edo1/cmdstalk/broker/metrics"
 	"github.com/edo1/cmdstalk/bs"
 	"github.com/edo1/cmdstalk/cmd"
 )
 
+// deadLetterTTR is the TTR given to jobs forwarded to a dead-letter tube.
+// Dead-lettered jobs aren't executed by cmdstalk itself, so this only
+// needs to be long enough for an operator (or kick) to notice them.
+const deadLetterTTR = 60 * time.Second
+
 const (
 	// ttrMargin compensates for beanstalkd's integer precision.
 	// e.g. reserving a TTR=1 job will show time-left=0.
@@ -31,6 +42,23 @@ const (
 	ReleaseTries = 10
 )
 
+// ReconnectPolicy controls how a Broker redials beanstalkd after the
+// connection is lost. Delay backs off exponentially from InitialDelay,
+// capped at MaxDelay, with a little jitter added so a fleet of brokers
+// doesn't hammer beanstalkd in lockstep. MaxAttempts of zero means retry
+// forever.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	MaxAttempts  int
+}
+
+// DefaultReconnectPolicy backs off from 1s to 30s and retries forever.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: 1 * time.Second,
+	MaxDelay:     30 * time.Second,
+}
+
 type Broker struct {
 
 	// Address of the beanstalkd server.
@@ -42,12 +70,77 @@ type Broker struct {
 	// Tube name this broker will service.
 	Tube string
 
+	// Reconnect governs redial behaviour when the beanstalkd connection
+	// is lost. The zero value is treated as DefaultReconnectPolicy.
+	Reconnect ReconnectPolicy
+
+	// Pool, if set, is acquired for Weight slots before a job's command is
+	// spawned and released once it exits, capping how many commands may
+	// run concurrently across every tube sharing the pool.
+	Pool   *WorkerPool
+	Weight uint64
+
+	// DeadLetterTube, if set, is where jobs that exhaust TimeoutTries or
+	// ReleaseTries are put instead of being left buried.
+	DeadLetterTube string
+
+	// Policy, if set, replaces TimeoutTries/ReleaseTries and the built-in
+	// r^4 release backoff with a pluggable decision of whether to release
+	// (and with what delay), bury, delete, or dead-letter a job.
+	Policy RetryPolicy
+
+	// Metrics, if set, receives a lifecycle Event for every reserve,
+	// execution, and disposition of a job. Sends are non-blocking so a
+	// slow or absent collector never affects the hot path.
+	Metrics chan<- metrics.Event
+
+	// JobWg, if set, is incremented while a job's command is executing and
+	// decremented once it finishes, letting a BrokerDispatcher's Drain know
+	// when all in-flight commands across every tube have completed.
+	JobWg *sync.WaitGroup
+
+	// Hard, if cancelled, forcibly terminates the currently-executing
+	// command rather than waiting for it to finish naturally. Unlike ctx
+	// (which only stops the broker from reserving new jobs), cancelling
+	// Hard acts on a job mid-execution.
+	Hard context.Context
+
 	log         *log.Logger
 	results     chan<- *JobResult
 	jobReceived chan<- struct{}
 	ctx         context.Context
+
+	conn *beanstalk.Conn
+	ts   *beanstalk.TubeSet
+
+	// lastResult remembers the most recent execution result per job id, so
+	// that if the job later exhausts its retries the dead-letter header
+	// can report the exit status and stdout that caused the releases.
+	lastResult map[uint64]*JobResult
+}
+
+// deadLetterHeader is JSON-encoded and prepended, followed by a newline,
+// to a job's original body when it is forwarded to DeadLetterTube.
+type deadLetterHeader struct {
+	Tube       string `json:"tube"`
+	JobId      uint64 `json:"job_id"`
+	Reason     string `json:"reason"`
+	Timeouts   int    `json:"timeouts"`
+	Releases   int    `json:"releases"`
+	ExitStatus int    `json:"exit_status,omitempty"`
+	StdoutTail string `json:"stdout_tail,omitempty"`
 }
 
+// stdoutTailLen is how many trailing bytes of a job's stdout are kept in
+// the dead-letter header.
+const stdoutTailLen = 256
+
+// errShuttingDown is returned by executeJob when a job was still waiting on
+// a Pool slot when b.Hard was cancelled, so Run knows to release the job
+// back to beanstalkd instead of panicking on what would otherwise look like
+// an ordinary execution failure.
+var errShuttingDown = errors.New("broker: shutting down")
+
 type JobResult struct {
 
 	// Buried is true if the job was buried.
@@ -71,6 +164,23 @@ type JobResult struct {
 
 	// Error raised while attempting to handle the job.
 	Error error
+
+	// Directive is parsed from the last line of Stdout, if it is a valid
+	// WorkerDirective, letting the worker control the job's disposition
+	// directly instead of relying solely on ExitStatus.
+	Directive *WorkerDirective
+}
+
+// WorkerDirective lets a worker command control what happens to its job
+// next by writing a JSON object as the last line of its stdout, instead of
+// (or alongside) signalling through its exit status.
+type WorkerDirective struct {
+	// Action is one of "release", "bury", or "delete".
+	Action string `json:"action"`
+
+	// Delay is parsed with time.ParseDuration and applies to a "release"
+	// action; it's ignored otherwise.
+	Delay string `json:"delay,omitempty"`
 }
 
 // New broker instance.
@@ -78,11 +188,13 @@ func New(ctx context.Context, address, tube string, slot uint64, cmd string, res
 	b.Address = address
 	b.Tube = tube
 	b.Cmd = cmd
+	b.Reconnect = DefaultReconnectPolicy
 
 	b.log = log.New(os.Stdout, fmt.Sprintf("[%s:%d] ", tube, slot), log.LstdFlags)
 	b.results = results
 	b.jobReceived = jobReceived
 	b.ctx = ctx
+	b.lastResult = make(map[uint64]*JobResult)
 	return
 }
 
@@ -90,14 +202,11 @@ func New(ctx context.Context, address, tube string, slot uint64, cmd string, res
 // If ticks channel is present, one job is processed per tick.
 func (b *Broker) Run(ticks chan bool) {
 	b.log.Println("command:", b.Cmd)
-	b.log.Println("connecting to", b.Address)
-	conn, err := beanstalk.Dial("tcp", b.Address)
-	if err != nil {
-		panic(err)
-	}
 
-	b.log.Println("watching", b.Tube)
-	ts := beanstalk.NewTubeSet(conn, b.Tube)
+	if err := b.dial(); err != nil {
+		b.log.Println("giving up:", err)
+		return
+	}
 
 	b.log.Println("starting reserve loop (waiting for job)")
 	for {
@@ -111,44 +220,60 @@ func (b *Broker) Run(ticks chan bool) {
 			break
 		}
 
-		id, body, err := bs.MustReserveWithTimeout(ts, 1*time.Second)
+		reserveStart := time.Now()
+		id, body, err := b.reserve()
+		reserveLatency := time.Since(reserveStart)
 		if err == bs.ErrTimeout {
 			// Doing this to be able to gracefully handle cancelled context.
 			continue
 		}
+		if isConnError(err) {
+			if !b.handleConnError(err) {
+				break
+			}
+			continue
+		}
 
-		job := bs.NewJob(id, body, conn)
+		job := bs.NewJob(id, body, b.conn)
+		b.emitMetric(metrics.Event{Type: metrics.Reserved, Duration: reserveLatency})
 
 		b.jobReceived <- struct{}{}
 
-		t, err := job.Timeouts()
-		if err != nil {
-			b.log.Panic(err)
-		}
-		if t >= TimeoutTries {
-			b.log.Printf("job %d has %d timeouts, burying", job.Id, t)
-			job.Bury()
-			if b.results != nil {
-				b.results <- &JobResult{JobId: job.Id, Buried: true}
+		t, err := safeTimeouts(job)
+		if isConnError(err) {
+			if !b.handleConnError(err) {
+				break
 			}
 			continue
+		} else if err != nil {
+			b.log.Panic(err)
 		}
 
-		releases, err := job.Releases()
-		if err != nil {
+		releases, err := safeReleases(job)
+		if isConnError(err) {
+			if !b.handleConnError(err) {
+				break
+			}
+			continue
+		} else if err != nil {
 			b.log.Panic(err)
 		}
-		if releases >= ReleaseTries {
-			b.log.Printf("job %d has %d releases, burying", job.Id, releases)
-			job.Bury()
-			if b.results != nil {
-				b.results <- &JobResult{JobId: job.Id, Buried: true}
-			}
+
+		if exhausted, reason := b.retriesExhausted(t, releases); exhausted {
+			b.log.Printf("job %d exceeded retries (%s), burying", job.Id, reason)
+			b.buryOrDeadLetter(job, reason, t, releases)
 			continue
 		}
 
 		b.log.Printf("executing job %d", job.Id)
 		result, err := b.executeJob(job, b.Cmd)
+		if err == errShuttingDown {
+			b.log.Printf("job %d: abandoning pool wait for shutdown, releasing", job.Id)
+			if rerr := job.Release(0); rerr != nil {
+				b.log.Println("failed to release job", job.Id, "during shutdown:", rerr)
+			}
+			continue
+		}
 		if err != nil {
 			log.Panic(err)
 		}
@@ -170,6 +295,152 @@ func (b *Broker) Run(ticks chan bool) {
 	b.log.Println("broker finished")
 }
 
+// dial connects to beanstalkd and watches b.Tube, storing the connection
+// and tube set on the broker.
+func (b *Broker) dial() error {
+	b.log.Println("connecting to", b.Address)
+	conn, err := beanstalk.Dial("tcp", b.Address)
+	if err != nil {
+		return err
+	}
+
+	b.log.Println("watching", b.Tube)
+	b.conn = conn
+	b.ts = beanstalk.NewTubeSet(conn, b.Tube)
+	return nil
+}
+
+// reserve wraps bs.MustReserveWithTimeout, recovering from the panic its
+// Must-style naming implies on anything other than a reserve timeout. Without
+// this, a lost connection during reserve would crash the process instead of
+// reaching isConnError/handleConnError below.
+func (b *Broker) reserve() (id uint64, body []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicToErr(r)
+		}
+	}()
+	return bs.MustReserveWithTimeout(b.ts, 1*time.Second)
+}
+
+// safeTimeouts wraps job.Timeouts, recovering from a panic on a lost
+// connection the same way reserve does.
+func safeTimeouts(job bs.Job) (timeouts int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicToErr(r)
+		}
+	}()
+	return job.Timeouts()
+}
+
+// safeReleases wraps job.Releases, recovering from a panic on a lost
+// connection the same way reserve does.
+func safeReleases(job bs.Job) (releases int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicToErr(r)
+		}
+	}()
+	return job.Releases()
+}
+
+// panicToErr converts a recovered panic value into an error, preserving its
+// concrete type (e.g. beanstalk.ConnError) when it already is one so
+// isConnError still classifies it correctly.
+func panicToErr(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", r)
+}
+
+// handleConnError logs a lost beanstalkd connection and redials according
+// to b.Reconnect, reassigning b.conn/b.ts on success. It reports false if
+// the reconnect policy was exhausted or the context was cancelled, in
+// which case Run should stop.
+func (b *Broker) handleConnError(err error) bool {
+	b.log.Println("lost connection to beanstalkd:", err)
+	if rerr := b.reconnect(); rerr != nil {
+		b.log.Println("giving up reconnecting:", rerr)
+		return false
+	}
+	return true
+}
+
+// reconnect redials beanstalkd, backing off exponentially between
+// attempts per b.Reconnect, until it succeeds, the policy's MaxAttempts is
+// exhausted, or b.ctx is cancelled.
+func (b *Broker) reconnect() error {
+	policy := b.Reconnect
+	if policy.InitialDelay <= 0 {
+		policy = DefaultReconnectPolicy
+	}
+
+	delay := policy.InitialDelay
+	for attempt := 1; ; attempt++ {
+		if isCancelled(b.ctx) {
+			return b.ctx.Err()
+		}
+
+		err := b.dial()
+		if err == nil {
+			return nil
+		}
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		b.log.Printf("redial attempt %d failed: %v; retrying in %v", attempt, err, delay)
+		select {
+		case <-time.After(jitter(delay)):
+		case <-b.ctx.Done():
+			return b.ctx.Err()
+		}
+
+		if delay *= 2; delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
+
+// jitter adds up to 20% random variance to d, so many brokers reconnecting
+// at once don't redial in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// isConnError reports whether err should be handled as a lost beanstalkd
+// connection, meaning the broker should redial rather than panic. Every
+// non-nil error counts as one except the expected reserve timeout and
+// deadline-soon responses.
+func isConnError(err error) bool {
+	if err == nil || err == bs.ErrTimeout {
+		return false
+	}
+	if cerr, ok := err.(beanstalk.ConnError); ok {
+		switch cerr.Err {
+		case beanstalk.ErrTimeout, beanstalk.ErrDeadline:
+			return false
+		}
+	}
+	return true
+}
+
+// emitMetric sends e to b.Metrics without blocking, dropping it if no
+// collector is configured or its buffer is full.
+func (b *Broker) emitMetric(e metrics.Event) {
+	if b.Metrics == nil {
+		return
+	}
+	e.Tube = b.Tube
+	select {
+	case b.Metrics <- e:
+	default:
+	}
+}
+
 func isCancelled(ctx context.Context) bool {
 	select {
 	case <-ctx.Done():
@@ -179,16 +450,52 @@ func isCancelled(ctx context.Context) bool {
 	}
 }
 
+// hard returns b.Hard's Done channel, or nil if no hard-stop context is
+// configured; a nil channel blocks forever in a select, so callers can use
+// the result unconditionally.
+func (b *Broker) hard() <-chan struct{} {
+	if b.Hard == nil {
+		return nil
+	}
+	return b.Hard.Done()
+}
+
 func (b *Broker) executeJob(job bs.Job, shellCmd string) (result *JobResult, err error) {
 	result = &JobResult{JobId: job.Id, Executed: true}
 
+	if b.Pool != nil {
+		// Wait on b.Hard, not b.ctx: b.ctx is cancelled on an ordinary
+		// stop-reserving request (--max-jobs, or the first SIGINT of a
+		// graceful Drain), which should let an already-reserved job keep
+		// waiting for a slot rather than abandoning it.
+		acquireCtx := b.Hard
+		if acquireCtx == nil {
+			acquireCtx = context.Background()
+		}
+		if aerr := b.Pool.Acquire(acquireCtx, b.Weight); aerr != nil {
+			return result, errShuttingDown
+		}
+		defer b.Pool.Release(b.Weight)
+	}
+
+	execStart := time.Now()
+	b.emitMetric(metrics.Event{Type: metrics.Started})
+	defer func() {
+		b.emitMetric(metrics.Event{Type: metrics.Executed, Duration: time.Since(execStart)})
+	}()
+
+	if b.JobWg != nil {
+		b.JobWg.Add(1)
+		defer b.JobWg.Done()
+	}
+
 	ttr, err := job.TimeLeft()
 	ticker := time.NewTicker(ttr - ttrMargin)
 	if err != nil {
 		return
 	}
 
-	cmd, out, err := cmd.NewCommand(shellCmd)
+	cmd, out, err := cmd.NewCommandWithEnv(shellCmd, jobEnv(job))
 	if err != nil {
 		return
 	}
@@ -197,6 +504,8 @@ func (b *Broker) executeJob(job bs.Job, shellCmd string) (result *JobResult, err
 		return
 	}
 
+	hardDone := b.hard()
+
 	// TODO: end loop when stdout closes
 stdoutReader:
 	for {
@@ -208,6 +517,10 @@ stdoutReader:
 			//	return
 			//}
 			//result.TimedOut = true
+		case <-hardDone:
+			b.log.Printf("force-terminating job %d", job.Id)
+			cmd.Terminate()
+			hardDone = nil
 		case data, ok := <-out:
 			if !ok {
 				break stdoutReader
@@ -235,23 +548,74 @@ waitLoop:
 		case <-timer.C:
 			cmd.Terminate()
 			result.TimedOut = true
+		case <-hardDone:
+			b.log.Printf("force-terminating job %d", job.Id)
+			cmd.Terminate()
+			hardDone = nil
+		}
+	}
+
+	if line := lastLine(result.Stdout); line != "" {
+		var d WorkerDirective
+		if jsonErr := json.Unmarshal([]byte(line), &d); jsonErr == nil && d.Action != "" {
+			result.Directive = &d
 		}
 	}
 
 	return
 }
 
+// jobEnv builds the BEANSTALK_* environment variables passed to a job's
+// worker command, sourced from the job's beanstalkd stats.
+func jobEnv(job bs.Job) []string {
+	stats, err := job.Stats()
+	if err != nil {
+		stats = map[string]string{}
+	}
+	return []string{
+		fmt.Sprintf("BEANSTALK_JOB_ID=%d", job.Id),
+		"BEANSTALK_TUBE=" + stats["tube"],
+		"BEANSTALK_PRIORITY=" + stats["pri"],
+		"BEANSTALK_AGE=" + stats["age"],
+		"BEANSTALK_RELEASES=" + stats["releases"],
+		"BEANSTALK_TIMEOUTS=" + stats["timeouts"],
+		"BEANSTALK_TTR=" + stats["ttr"],
+	}
+}
+
+// lastLine returns the last non-empty line of b.
+func lastLine(b []byte) string {
+	b = bytes.TrimRight(b, " \t\r\n")
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		b = b[i+1:]
+	}
+	return string(bytes.TrimSpace(b))
+}
+
 func (b *Broker) handleResult(job bs.Job, result *JobResult) (err error) {
 	if result.TimedOut {
 		b.log.Printf("job %d timed out", job.Id)
+		b.emitMetric(metrics.Event{Type: metrics.TimedOut})
 		return
 	}
 	b.log.Printf("job %d finished with exit(%d)", job.Id, result.ExitStatus)
-	switch result.ExitStatus {
-	case 0:
+
+	if result.Directive != nil {
+		if err, handled := b.handleDirective(job, result.Directive); handled {
+			return err
+		}
+	}
+
+	if result.ExitStatus == 0 {
 		b.log.Printf("deleting job %d", job.Id)
 		err = job.Delete()
-	default:
+		b.forgetLastResult(job.Id)
+		b.emitMetric(metrics.Event{Type: metrics.Deleted})
+		return err
+	}
+	b.lastResult[job.Id] = result
+
+	if b.Policy == nil {
 		r, err := job.Releases()
 		if err != nil {
 			r = ReleaseTries
@@ -261,6 +625,176 @@ func (b *Broker) handleResult(job bs.Job, result *JobResult) (err error) {
 		delay := time.Duration(r*r*r*r) * time.Second
 		b.log.Printf("releasing job %d with %v delay (%d retries)", job.Id, delay, r)
 		err = job.Release(delay)
+		b.emitMetric(metrics.Event{Type: metrics.Released})
+		return err
 	}
-	return
+
+	releases, err := job.Releases()
+	if err != nil {
+		releases = ReleaseTries
+	}
+	timeouts, err := job.Timeouts()
+	if err != nil {
+		timeouts = TimeoutTries
+	}
+
+	delay, action := b.Policy.NextDelay(releases, timeouts, result.ExitStatus)
+	switch action {
+	case Delete:
+		b.log.Printf("policy deletes job %d", job.Id)
+		err = job.Delete()
+		b.forgetLastResult(job.Id)
+		b.emitMetric(metrics.Event{Type: metrics.Deleted})
+		return err
+	case Bury:
+		b.log.Printf("policy buries job %d", job.Id)
+		err = job.Bury()
+		result.Buried = true
+		b.forgetLastResult(job.Id)
+		b.emitMetric(metrics.Event{Type: metrics.Buried})
+		return err
+	case DeadLetter:
+		b.log.Printf("policy dead-letters job %d", job.Id)
+		if !b.deadLetter(job, "policy", timeouts, releases) {
+			job.Bury()
+			b.forgetLastResult(job.Id)
+		}
+		b.emitMetric(metrics.Event{Type: metrics.Buried})
+		return nil
+	default:
+		b.log.Printf("releasing job %d with %v delay (policy)", job.Id, delay)
+		err = job.Release(delay)
+		b.emitMetric(metrics.Event{Type: metrics.Released})
+		return err
+	}
+}
+
+// handleDirective applies a WorkerDirective parsed from a job's worker
+// stdout, if it names a recognised action. handled is false (and err is
+// always nil) for an unrecognised action, or for a "release" whose Delay
+// does not parse, telling the caller to fall back to its usual exit-status
+// handling instead.
+func (b *Broker) handleDirective(job bs.Job, d *WorkerDirective) (err error, handled bool) {
+	switch d.Action {
+	case "delete":
+		b.log.Printf("job %d: worker directed delete", job.Id)
+		err = job.Delete()
+		b.forgetLastResult(job.Id)
+		b.emitMetric(metrics.Event{Type: metrics.Deleted})
+		return err, true
+
+	case "bury":
+		b.log.Printf("job %d: worker directed bury", job.Id)
+		err = job.Bury()
+		b.forgetLastResult(job.Id)
+		b.emitMetric(metrics.Event{Type: metrics.Buried})
+		return err, true
+
+	case "release":
+		delay, perr := time.ParseDuration(d.Delay)
+		if perr != nil {
+			b.log.Printf("job %d: invalid directive delay %q, falling back to exit status", job.Id, d.Delay)
+			return nil, false
+		}
+		b.log.Printf("job %d: worker directed release with %v delay", job.Id, delay)
+		err = job.Release(delay)
+		b.emitMetric(metrics.Event{Type: metrics.Released})
+		return err, true
+
+	default:
+		b.log.Printf("job %d: unrecognised directive action %q, falling back to exit status", job.Id, d.Action)
+		return nil, false
+	}
+}
+
+// retriesExhausted reports whether job has used up its retries and should
+// be buried (or dead-lettered) instead of executed again. If b.Policy is
+// set, its Exhausted method decides; otherwise the legacy
+// TimeoutTries/ReleaseTries constants apply.
+func (b *Broker) retriesExhausted(timeouts, releases int) (bool, string) {
+	if b.Policy != nil {
+		return b.Policy.Exhausted(releases, timeouts), "policy"
+	}
+	if timeouts >= TimeoutTries {
+		return true, "timeouts"
+	}
+	if releases >= ReleaseTries {
+		return true, "releases"
+	}
+	return false, ""
+}
+
+// buryOrDeadLetter buries job, or, if DeadLetterTube is configured,
+// forwards it there with a header describing why instead of leaving it
+// stuck in the buried state. Either way a JobResult marking the job as
+// buried is emitted.
+func (b *Broker) buryOrDeadLetter(job bs.Job, reason string, timeouts, releases int) {
+	if !b.deadLetter(job, reason, timeouts, releases) {
+		job.Bury()
+		b.forgetLastResult(job.Id)
+	}
+	b.emitMetric(metrics.Event{Type: metrics.Buried})
+	if b.results != nil {
+		b.results <- &JobResult{JobId: job.Id, Buried: true}
+	}
+}
+
+// forgetLastResult discards the remembered execution result for jobID, once
+// it's been deleted, buried, or dead-lettered and so can no longer exhaust
+// its retries in the future. Without this, lastResult would grow forever
+// for a long-running broker.
+func (b *Broker) forgetLastResult(jobID uint64) {
+	delete(b.lastResult, jobID)
+}
+
+// deadLetter puts job into b.DeadLetterTube with a JSON header describing
+// why it was pulled out of its original tube, then deletes the original.
+// It reports false (leaving job untouched) if no DeadLetterTube is
+// configured or if forwarding the job fails.
+func (b *Broker) deadLetter(job bs.Job, reason string, timeouts, releases int) bool {
+	if b.DeadLetterTube == "" {
+		return false
+	}
+
+	header := deadLetterHeader{
+		Tube:     b.Tube,
+		JobId:    job.Id,
+		Reason:   reason,
+		Timeouts: timeouts,
+		Releases: releases,
+	}
+	if last, ok := b.lastResult[job.Id]; ok {
+		header.ExitStatus = last.ExitStatus
+		header.StdoutTail = tail(last.Stdout, stdoutTailLen)
+	}
+	b.forgetLastResult(job.Id)
+
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		b.log.Println("failed to encode dead-letter header for job", job.Id, ":", err)
+		return false
+	}
+
+	body := append(encoded, '\n')
+	body = append(body, job.Body...)
+
+	dead := beanstalk.Tube{Conn: b.conn, Name: b.DeadLetterTube}
+	if _, err := dead.Put(body, 1024, 0, deadLetterTTR); err != nil {
+		b.log.Println("failed to dead-letter job", job.Id, ":", err)
+		return false
+	}
+
+	b.log.Printf("dead-lettered job %d to tube %s (%s)", job.Id, b.DeadLetterTube, reason)
+	if err := job.Delete(); err != nil {
+		b.log.Println("dead-lettered job", job.Id, "but failed to delete original:", err)
+	}
+	return true
+}
+
+// tail returns the last n bytes of b, or all of b if it's shorter.
+func tail(b []byte, n int) string {
+	if len(b) > n {
+		b = b[len(b)-n:]
+	}
+	return string(b)
 }
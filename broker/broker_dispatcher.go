@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/beanstalkd/go-beanstalk"
+	"github.com/edo1/cmdstalk/broker/metrics"
 )
 
 const (
@@ -20,35 +21,142 @@ const (
 // created. The `perTube` option determines how many brokers are started for
 // each tube.
 type BrokerDispatcher struct {
-	address     string
-	cmd         string
-	conn        *beanstalk.Conn
-	perTube     uint64
-	tubeSet     map[string]bool
-	jobReceived chan<- struct{}
-	ctx         context.Context
-	wg          sync.WaitGroup
-}
-
-func NewBrokerDispatcher(parentCtx context.Context, address, cmd string, perTube, maxJobs uint64) *BrokerDispatcher {
-	ctx, cancel := context.WithCancel(parentCtx)
+	address string
+	cmd     string
+	conn    *beanstalk.Conn
+	perTube uint64
+
+	// tubeSet and tubeSetMu guard the set of tubes this dispatcher watches.
+	// It's written from RunTube (driven by the main goroutine or the -all
+	// tube-discovery goroutine) and read from the kicker, pauseAllTubes, and
+	// watchedTubes goroutines, so every access must go through tubeSetMu.
+	tubeSet       map[string]bool
+	tubeSetMu     sync.Mutex
+	jobReceived   chan<- struct{}
+	ctx           context.Context
+	cancelReserve context.CancelFunc
+	wg            sync.WaitGroup
+
+	// jobWg counts in-flight worker commands across every Broker this
+	// dispatcher runs, separately from wg (which tracks broker goroutines
+	// themselves), so Drain knows when it's safe to stop waiting.
+	jobWg sync.WaitGroup
+
+	// hardCtx is cancelled to forcibly terminate in-flight commands once
+	// a drain's timeout has elapsed, or on a second shutdown signal.
+	hardCtx    context.Context
+	cancelHard context.CancelFunc
+
+	// Reconnect is passed through to every Broker this dispatcher starts.
+	// The zero value is treated as DefaultReconnectPolicy.
+	Reconnect ReconnectPolicy
+
+	// pool caps the number of commands executing concurrently across all
+	// tubes this dispatcher manages. A maxConcurrent of zero gives a pool
+	// with no limit, whose Acquire and Release do nothing.
+	pool *WorkerPool
+
+	// tubeWeight holds per-tube slot costs against pool, set via
+	// SetTubeWeight. Tubes not present here default to a weight of 1.
+	tubeWeight map[string]uint64
+
+	// tubePolicy holds per-tube RetryPolicy overrides, set via
+	// SetTubePolicy. Tubes not present here fall back to DefaultPolicy.
+	tubePolicy map[string]RetryPolicy
+
+	// DefaultPolicy is used for tubes with no entry in tubePolicy. A nil
+	// DefaultPolicy means those tubes keep the legacy
+	// TimeoutTries/ReleaseTries/r^4 behaviour.
+	DefaultPolicy RetryPolicy
+
+	// Metrics, if set (via EnableMetrics), collects job lifecycle events
+	// from every Broker this dispatcher runs and serves them over HTTP.
+	Metrics *metrics.Collector
+
+	// DeadLetterTube, if set, is passed to every Broker this dispatcher
+	// starts; jobs that exhaust their retries are forwarded there instead
+	// of being left buried.
+	DeadLetterTube string
+
+	// KickInterval, if positive, makes the dispatcher periodically kick
+	// buried jobs (up to KickMax per tube per tick) back into service on
+	// every tube it watches, giving them another chance after a cool-off.
+	KickInterval time.Duration
+	KickMax      int
+
+	kickerOnce sync.Once
+}
+
+// NewBrokerDispatcher creates a dispatcher. maxConcurrent caps the total
+// number of worker commands running at once across every tube; zero means
+// unlimited.
+func NewBrokerDispatcher(parentCtx context.Context, address, cmd string, perTube, maxJobs, maxConcurrent uint64) *BrokerDispatcher {
+	ctx, cancelReserve := context.WithCancel(parentCtx)
+	hardCtx, cancelHard := context.WithCancel(parentCtx)
 	jobReceived := make(chan struct{})
-	go limittedCountGenerator(maxJobs, cancel, jobReceived)
+	go limittedCountGenerator(maxJobs, cancelReserve, jobReceived)
 	return &BrokerDispatcher{
-		address:     address,
-		cmd:         cmd,
-		perTube:     perTube,
-		tubeSet:     make(map[string]bool),
-		jobReceived: jobReceived,
-		ctx:         ctx,
+		address:       address,
+		cmd:           cmd,
+		perTube:       perTube,
+		tubeSet:       make(map[string]bool),
+		jobReceived:   jobReceived,
+		ctx:           ctx,
+		cancelReserve: cancelReserve,
+		hardCtx:       hardCtx,
+		cancelHard:    cancelHard,
+		Reconnect:     DefaultReconnectPolicy,
+		pool:          NewWorkerPool(maxConcurrent),
+		tubeWeight:    make(map[string]uint64),
+		tubePolicy:    make(map[string]RetryPolicy),
+	}
+}
+
+// SetTubeWeight sets how many of the dispatcher's pool slots a single
+// concurrently-executing job on tube costs. Tubes default to a weight of
+// 1 if never set.
+func (bd *BrokerDispatcher) SetTubeWeight(tube string, weight uint64) {
+	bd.tubeWeight[tube] = weight
+}
+
+// SetTubePolicy overrides the RetryPolicy used for tube, in place of
+// DefaultPolicy.
+func (bd *BrokerDispatcher) SetTubePolicy(tube string, policy RetryPolicy) {
+	bd.tubePolicy[tube] = policy
+}
+
+// EnableMetrics starts a metrics.Collector that polls beanstalkd every
+// statsInterval and consumes lifecycle events from every Broker this
+// dispatcher runs, serving both over HTTP on addr.
+func (bd *BrokerDispatcher) EnableMetrics(addr string, statsInterval time.Duration) {
+	bd.Metrics = metrics.NewCollector(bd.address, bd.watchedTubes, statsInterval)
+	go bd.Metrics.Run(bd.ctx)
+	go func() {
+		if err := bd.Metrics.ListenAndServe(addr); err != nil {
+			log.Println("metrics: HTTP server stopped:", err)
+		}
+	}()
+}
+
+// watchedTubes returns a snapshot of the tubes currently being watched.
+func (bd *BrokerDispatcher) watchedTubes() []string {
+	bd.tubeSetMu.Lock()
+	defer bd.tubeSetMu.Unlock()
+	tubes := make([]string, 0, len(bd.tubeSet))
+	for tube := range bd.tubeSet {
+		tubes = append(tubes, tube)
 	}
+	return tubes
 }
 
 // RunTube runs broker(s) for the specified tube.
 // The number of brokers started is determined by the perTube argument to
 // NewBrokerDispatcher.
 func (bd *BrokerDispatcher) RunTube(tube string) {
+	bd.tubeSetMu.Lock()
 	bd.tubeSet[tube] = true
+	bd.tubeSetMu.Unlock()
+	bd.kickerOnce.Do(bd.startKicker)
 	for i := uint64(0); i < bd.perTube; i++ {
 		bd.runBroker(tube, i)
 	}
@@ -63,10 +171,7 @@ func (bd *BrokerDispatcher) RunTubes(tubes []string) {
 
 // RunAllTubes polls beanstalkd, running broker as new tubes are created.
 func (bd *BrokerDispatcher) RunAllTubes() (err error) {
-	conn, err := beanstalk.Dial("tcp", bd.address)
-	if err == nil {
-		bd.conn = conn
-	} else {
+	if err = bd.dialListTubes(); err != nil {
 		return
 	}
 
@@ -74,7 +179,10 @@ func (bd *BrokerDispatcher) RunAllTubes() (err error) {
 		ticker := instantTicker(ListTubeDelay)
 		for _ = range ticker {
 			if e := bd.watchNewTubes(); e != nil {
-				log.Println(e)
+				log.Println("list-tubes failed, reconnecting:", e)
+				if e := bd.dialListTubes(); e != nil {
+					log.Println("giving up reconnecting list-tubes connection:", e)
+				}
 			}
 		}
 	}()
@@ -82,6 +190,111 @@ func (bd *BrokerDispatcher) RunAllTubes() (err error) {
 	return
 }
 
+// Drain begins a graceful shutdown: it pauses every tube this dispatcher
+// watches, so beanstalkd stops handing out new jobs from them, and stops
+// each Broker's reserve loop. It then waits up to timeout for commands
+// already in flight to finish naturally before forcibly terminating them
+// via ForceShutdown.
+func (bd *BrokerDispatcher) Drain(timeout time.Duration) {
+	log.Println("draining: pausing watched tubes and waiting up to", timeout, "for in-flight jobs")
+	bd.pauseAllTubes(timeout)
+	bd.cancelReserve()
+
+	done := make(chan struct{})
+	go func() {
+		bd.jobWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("drain complete: all in-flight jobs finished")
+	case <-time.After(timeout):
+		log.Println("drain timeout exceeded: terminating in-flight jobs")
+		bd.ForceShutdown()
+	}
+}
+
+// ForceShutdown immediately terminates any in-flight worker commands,
+// without waiting any further for them to finish naturally.
+func (bd *BrokerDispatcher) ForceShutdown() {
+	bd.cancelHard()
+}
+
+// pauseAllTubes issues pause-tube, for roughly timeout, against every tube
+// this dispatcher watches, so beanstalkd stops handing out new jobs from
+// them while we drain.
+func (bd *BrokerDispatcher) pauseAllTubes(timeout time.Duration) {
+	conn, err := beanstalk.Dial("tcp", bd.address)
+	if err != nil {
+		log.Println("drain: failed to connect to beanstalkd to pause tubes:", err)
+		return
+	}
+	defer conn.Close()
+
+	for _, tube := range bd.watchedTubes() {
+		t := beanstalk.Tube{Conn: conn, Name: tube}
+		if err := t.Pause(timeout); err != nil {
+			log.Println("drain: failed to pause tube", tube, ":", err)
+		}
+	}
+}
+
+// dialListTubes (re)connects bd.conn, the connection used to poll
+// beanstalkd for newly created tubes.
+func (bd *BrokerDispatcher) dialListTubes() error {
+	conn, err := beanstalk.Dial("tcp", bd.address)
+	if err != nil {
+		return err
+	}
+	bd.conn = conn
+	return nil
+}
+
+// startKicker connects a dedicated beanstalkd connection and, if
+// KickInterval is positive, periodically kicks up to KickMax buried jobs
+// back into service on every tube bd is watching.
+func (bd *BrokerDispatcher) startKicker() {
+	if bd.KickInterval <= 0 {
+		return
+	}
+
+	conn, err := beanstalk.Dial("tcp", bd.address)
+	if err != nil {
+		log.Println("kicker: failed to connect to beanstalkd:", err)
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(bd.KickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bd.kickAll(conn)
+			case <-bd.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// kickAll issues kick, bounded by KickMax, against every tube bd is
+// watching.
+func (bd *BrokerDispatcher) kickAll(conn *beanstalk.Conn) {
+	for _, tube := range bd.watchedTubes() {
+		t := beanstalk.Tube{Conn: conn, Name: tube}
+		n, err := t.Kick(bd.KickMax)
+		if err != nil {
+			log.Println("kick failed for tube", tube, ":", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("kicked %d buried job(s) on tube %s", n, tube)
+		}
+	}
+}
+
 // limittedCountGenerator creates a channel that returns a boolean channel with
 // nlimit true's and false otherwise. If nlimit is 0 it the channel will always
 // be containing true.
@@ -101,6 +314,20 @@ func (bd *BrokerDispatcher) runBroker(tube string, slot uint64) {
 	go func() {
 		defer bd.wg.Done()
 		b := New(bd.ctx, bd.address, tube, slot, bd.cmd, nil, bd.jobReceived)
+		b.Reconnect = bd.Reconnect
+		b.Pool = bd.pool
+		b.Weight = bd.tubeWeight[tube]
+		b.DeadLetterTube = bd.DeadLetterTube
+		if policy, ok := bd.tubePolicy[tube]; ok {
+			b.Policy = policy
+		} else {
+			b.Policy = bd.DefaultPolicy
+		}
+		b.JobWg = &bd.jobWg
+		b.Hard = bd.hardCtx
+		if bd.Metrics != nil {
+			b.Metrics = bd.Metrics.Events()
+		}
 		b.Run(nil)
 	}()
 }
@@ -116,7 +343,10 @@ func (bd *BrokerDispatcher) watchNewTubes() (err error) {
 	}
 
 	for _, tube := range tubes {
-		if !bd.tubeSet[tube] {
+		bd.tubeSetMu.Lock()
+		known := bd.tubeSet[tube]
+		bd.tubeSetMu.Unlock()
+		if !known {
 			bd.RunTube(tube)
 		}
 	}
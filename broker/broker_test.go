@@ -0,0 +1,40 @@
+package broker
+
+import "testing"
+
+func TestTail(t *testing.T) {
+	cases := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello world", 5, "world"},
+		{"", 5, ""},
+		{"abc", 3, "abc"},
+	}
+	for _, c := range cases {
+		if got := tail([]byte(c.in), c.n); got != c.want {
+			t.Errorf("tail(%q, %d) = %q, want %q", c.in, c.n, got, c.want)
+		}
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"single line", "single line"},
+		{"first\nsecond\n", "second"},
+		{"first\nsecond\nthird", "third"},
+		{"trailing blank\n\n", "trailing blank"},
+		{"", ""},
+		{"  spaced  \n", "spaced"},
+	}
+	for _, c := range cases {
+		if got := lastLine([]byte(c.in)); got != c.want {
+			t.Errorf("lastLine(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
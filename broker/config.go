@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// policyConfig is the top-level shape of a --config file: a RetryPolicy
+// spec per tube name.
+type policyConfig struct {
+	Tubes map[string]policySpec `yaml:"tubes"`
+}
+
+// policySpec is the YAML representation of a RetryPolicy. Type selects
+// which built-in policy fields below apply; unused fields are ignored.
+type policySpec struct {
+	Type        string               `yaml:"type"`
+	Base        string               `yaml:"base"`
+	Cap         string               `yaml:"cap"`
+	Jitter      string               `yaml:"jitter"`
+	Delay       string               `yaml:"delay"`
+	Unit        string               `yaml:"unit"`
+	MaxReleases int                  `yaml:"max_releases"`
+	Codes       map[int]exitCodeSpec `yaml:"codes"`
+	Default     *policySpec          `yaml:"default"`
+}
+
+type exitCodeSpec struct {
+	Action string `yaml:"action"`
+	Delay  string `yaml:"delay"`
+}
+
+// LoadPolicyConfig reads a YAML file mapping tube names to RetryPolicy
+// configuration (see the built-in policies in policy.go: "exponential",
+// "constant", "fibonacci", and "exit-code-map") and returns the resulting
+// per-tube policies.
+func LoadPolicyConfig(path string) (map[string]RetryPolicy, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg policyConfig
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	policies := make(map[string]RetryPolicy, len(cfg.Tubes))
+	for tube, spec := range cfg.Tubes {
+		policy, err := spec.build()
+		if err != nil {
+			return nil, fmt.Errorf("tube %q: %w", tube, err)
+		}
+		policies[tube] = policy
+	}
+	return policies, nil
+}
+
+func (s policySpec) build() (RetryPolicy, error) {
+	switch s.Type {
+	case "exponential":
+		base, err := parseDuration(s.Base, 1*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		capDelay, err := parseDuration(s.Cap, 30*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		jitter, err := parseDuration(s.Jitter, 0)
+		if err != nil {
+			return nil, err
+		}
+		return ExponentialPolicy{Base: base, Cap: capDelay, MaxReleases: s.MaxReleases, Jitter: jitter}, nil
+
+	case "constant":
+		delay, err := parseDuration(s.Delay, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return ConstantPolicy{Delay: delay, MaxReleases: s.MaxReleases}, nil
+
+	case "fibonacci":
+		unit, err := parseDuration(s.Unit, 1*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return FibonacciPolicy{Unit: unit, MaxReleases: s.MaxReleases}, nil
+
+	case "exit-code-map":
+		codes := make(map[int]ExitCodeRule, len(s.Codes))
+		for code, rule := range s.Codes {
+			action, err := parseAction(rule.Action)
+			if err != nil {
+				return nil, err
+			}
+			delay, err := parseDuration(rule.Delay, 0)
+			if err != nil {
+				return nil, err
+			}
+			codes[code] = ExitCodeRule{Action: action, Delay: delay}
+		}
+
+		var def RetryPolicy
+		if s.Default != nil {
+			var err error
+			if def, err = s.Default.build(); err != nil {
+				return nil, err
+			}
+		}
+		return ExitCodeMapPolicy{Codes: codes, Default: def}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown policy type %q", s.Type)
+	}
+}
+
+func parseDuration(s string, fallback time.Duration) (time.Duration, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func parseAction(s string) (Action, error) {
+	switch s {
+	case "release":
+		return Release, nil
+	case "bury":
+		return Bury, nil
+	case "delete":
+		return Delete, nil
+	case "dead-letter":
+		return DeadLetter, nil
+	default:
+		return 0, fmt.Errorf("unknown action %q", s)
+	}
+}
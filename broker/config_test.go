@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPolicyConfig(t *testing.T) {
+	path := writeConfig(t, `
+tubes:
+  emails:
+    type: exponential
+    base: 1s
+    cap: 30s
+    jitter: 500ms
+    max_releases: 5
+  reports:
+    type: constant
+    delay: 10s
+  imports:
+    type: fibonacci
+    unit: 2s
+  uploads:
+    type: exit-code-map
+    codes:
+      75:
+        action: release
+        delay: 60s
+      42:
+        action: bury
+    default:
+      type: constant
+      delay: 5s
+`)
+
+	policies, err := LoadPolicyConfig(path)
+	if err != nil {
+		t.Fatalf("LoadPolicyConfig: %v", err)
+	}
+
+	emails, ok := policies["emails"].(ExponentialPolicy)
+	if !ok {
+		t.Fatalf("emails policy = %T, want ExponentialPolicy", policies["emails"])
+	}
+	if emails.Base != time.Second || emails.Cap != 30*time.Second || emails.Jitter != 500*time.Millisecond || emails.MaxReleases != 5 {
+		t.Errorf("emails policy = %+v, unexpected fields", emails)
+	}
+
+	reports, ok := policies["reports"].(ConstantPolicy)
+	if !ok || reports.Delay != 10*time.Second {
+		t.Errorf("reports policy = %+v, want ConstantPolicy{Delay: 10s}", policies["reports"])
+	}
+
+	imports, ok := policies["imports"].(FibonacciPolicy)
+	if !ok || imports.Unit != 2*time.Second {
+		t.Errorf("imports policy = %+v, want FibonacciPolicy{Unit: 2s}", policies["imports"])
+	}
+
+	uploads, ok := policies["uploads"].(ExitCodeMapPolicy)
+	if !ok {
+		t.Fatalf("uploads policy = %T, want ExitCodeMapPolicy", policies["uploads"])
+	}
+	if rule := uploads.Codes[75]; rule.Action != Release || rule.Delay != 60*time.Second {
+		t.Errorf("uploads.Codes[75] = %+v, want {Release, 60s}", rule)
+	}
+	if rule := uploads.Codes[42]; rule.Action != Bury {
+		t.Errorf("uploads.Codes[42] = %+v, want {Bury, 0}", rule)
+	}
+	if def, ok := uploads.Default.(ConstantPolicy); !ok || def.Delay != 5*time.Second {
+		t.Errorf("uploads.Default = %+v, want ConstantPolicy{Delay: 5s}", uploads.Default)
+	}
+}
+
+func TestLoadPolicyConfigUnknownType(t *testing.T) {
+	path := writeConfig(t, `
+tubes:
+  widgets:
+    type: made-up
+`)
+	if _, err := LoadPolicyConfig(path); err == nil {
+		t.Fatal("LoadPolicyConfig with an unknown policy type returned nil error")
+	}
+}
+
+func TestLoadPolicyConfigMissingFile(t *testing.T) {
+	if _, err := LoadPolicyConfig(filepath.Join(os.TempDir(), "does-not-exist.yaml")); err == nil {
+		t.Fatal("LoadPolicyConfig on a missing file returned nil error")
+	}
+}
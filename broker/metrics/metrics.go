@@ -0,0 +1,257 @@
+/*
+	Package metrics collects job lifecycle events emitted by broker.Broker
+	instances and beanstalkd's own stats/stats-tube output, and exposes
+	both as a Prometheus-compatible /metrics endpoint plus a /healthz
+	check.
+*/
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beanstalkd/go-beanstalk"
+)
+
+// EventType enumerates the job lifecycle transitions a Broker reports.
+type EventType int
+
+const (
+	// Reserved is emitted after every reserve attempt that returns a job;
+	// Duration carries the reserve latency.
+	Reserved EventType = iota
+
+	// Started is emitted when a job's command begins executing.
+	Started
+
+	// Executed is emitted when a job's command finishes; Duration
+	// carries the execution time.
+	Executed
+
+	Deleted
+	Released
+	Buried
+	TimedOut
+)
+
+// Event is sent on a Collector's Events() channel for every job lifecycle
+// transition, so a Broker's hot path never has to take a lock itself.
+type Event struct {
+	Tube     string
+	Type     EventType
+	Duration time.Duration
+}
+
+type tubeCounters struct {
+	reserved, started, executed, deleted, released, buried, timedOut uint64
+	execDuration                                                     time.Duration
+	running                                                          int64
+	beanstalkStats                                                   map[string]string
+}
+
+// beanstalkGauges are the stats-tube keys surfaced as gauges alongside the
+// locally-tracked counters.
+var beanstalkGauges = []string{
+	"current-jobs-ready",
+	"current-jobs-reserved",
+	"current-jobs-buried",
+	"current-jobs-delayed",
+}
+
+// Collector consumes Events from Brokers and periodically polls
+// beanstalkd's stats/stats-tube, exposing both over HTTP.
+type Collector struct {
+	// Address of the beanstalkd server to poll for stats/stats-tube.
+	Address string
+
+	// Tubes returns the current set of tubes to poll stats-tube for.
+	Tubes func() []string
+
+	// StatsInterval is how often beanstalkd's stats/stats-tube are
+	// refreshed.
+	StatsInterval time.Duration
+
+	// ReserveLatencyBound, if positive, makes /healthz fail once the most
+	// recently observed reserve latency exceeds it.
+	ReserveLatencyBound time.Duration
+
+	events chan Event
+
+	mu                 sync.Mutex
+	counters           map[string]*tubeCounters
+	lastReserveLatency time.Duration
+	connHealthy        bool
+}
+
+// NewCollector creates a Collector. Call Run to start consuming events and
+// polling stats, and ListenAndServe to expose the HTTP endpoints.
+func NewCollector(address string, tubes func() []string, statsInterval time.Duration) *Collector {
+	return &Collector{
+		Address:             address,
+		Tubes:               tubes,
+		StatsInterval:       statsInterval,
+		ReserveLatencyBound: 5 * time.Second,
+		events:              make(chan Event, 1024),
+		counters:            make(map[string]*tubeCounters),
+	}
+}
+
+// Events returns the channel Brokers should send lifecycle Events to.
+func (c *Collector) Events() chan<- Event {
+	return c.events
+}
+
+// Run consumes Events and polls beanstalkd's stats until ctx is done. It
+// should be started in its own goroutine.
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.StatsInterval)
+	defer ticker.Stop()
+
+	c.pollStats()
+	for {
+		select {
+		case e := <-c.events:
+			c.apply(e)
+		case <-ticker.C:
+			c.pollStats()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Collector) apply(e Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.counters[e.Tube]
+	if t == nil {
+		t = &tubeCounters{}
+		c.counters[e.Tube] = t
+	}
+
+	switch e.Type {
+	case Reserved:
+		t.reserved++
+		c.lastReserveLatency = e.Duration
+	case Started:
+		t.started++
+		t.running++
+	case Executed:
+		t.executed++
+		t.execDuration += e.Duration
+		t.running--
+	case Deleted:
+		t.deleted++
+	case Released:
+		t.released++
+	case Buried:
+		t.buried++
+	case TimedOut:
+		t.timedOut++
+	}
+}
+
+// pollStats refreshes connHealthy and each tube's beanstalkd-reported
+// stats-tube snapshot.
+func (c *Collector) pollStats() {
+	conn, err := beanstalk.Dial("tcp", c.Address)
+	if err != nil {
+		c.setHealthy(false)
+		log.Println("metrics: failed to connect to beanstalkd:", err)
+		return
+	}
+	defer conn.Close()
+	c.setHealthy(true)
+
+	for _, tube := range c.Tubes() {
+		stats, err := (&beanstalk.Tube{Conn: conn, Name: tube}).Stats()
+		if err != nil {
+			log.Println("metrics: stats-tube failed for", tube, ":", err)
+			continue
+		}
+
+		c.mu.Lock()
+		t := c.counters[tube]
+		if t == nil {
+			t = &tubeCounters{}
+			c.counters[tube] = t
+		}
+		t.beanstalkStats = stats
+		c.mu.Unlock()
+	}
+}
+
+func (c *Collector) setHealthy(healthy bool) {
+	c.mu.Lock()
+	c.connHealthy = healthy
+	c.mu.Unlock()
+}
+
+// ServeMux returns the Collector's /metrics and /healthz handlers.
+func (c *Collector) ServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", c.handleMetrics)
+	mux.HandleFunc("/healthz", c.handleHealthz)
+	return mux
+}
+
+// ListenAndServe starts the metrics HTTP server on addr. It blocks, so
+// callers should run it in its own goroutine.
+func (c *Collector) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, c.ServeMux())
+}
+
+func (c *Collector) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tubes := make([]string, 0, len(c.counters))
+	for tube := range c.counters {
+		tubes = append(tubes, tube)
+	}
+	sort.Strings(tubes)
+
+	for _, tube := range tubes {
+		t := c.counters[tube]
+		fmt.Fprintf(w, "cmdstalk_jobs_reserved_total{tube=%q} %d\n", tube, t.reserved)
+		fmt.Fprintf(w, "cmdstalk_jobs_executed_total{tube=%q} %d\n", tube, t.executed)
+		fmt.Fprintf(w, "cmdstalk_jobs_deleted_total{tube=%q} %d\n", tube, t.deleted)
+		fmt.Fprintf(w, "cmdstalk_jobs_released_total{tube=%q} %d\n", tube, t.released)
+		fmt.Fprintf(w, "cmdstalk_jobs_buried_total{tube=%q} %d\n", tube, t.buried)
+		fmt.Fprintf(w, "cmdstalk_jobs_timed_out_total{tube=%q} %d\n", tube, t.timedOut)
+		fmt.Fprintf(w, "cmdstalk_jobs_running{tube=%q} %d\n", tube, t.running)
+		if t.executed > 0 {
+			avg := t.execDuration.Seconds() / float64(t.executed)
+			fmt.Fprintf(w, "cmdstalk_job_exec_seconds_avg{tube=%q} %f\n", tube, avg)
+		}
+		for _, key := range beanstalkGauges {
+			if v, ok := t.beanstalkStats[key]; ok {
+				fmt.Fprintf(w, "cmdstalk_beanstalkd_%s{tube=%q} %s\n", strings.Replace(key, "-", "_", -1), tube, v)
+			}
+		}
+	}
+}
+
+func (c *Collector) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	healthy := c.connHealthy
+	latency := c.lastReserveLatency
+	c.mu.Unlock()
+
+	if !healthy {
+		http.Error(w, "beanstalkd connection down", http.StatusServiceUnavailable)
+		return
+	}
+	if c.ReserveLatencyBound > 0 && latency > c.ReserveLatencyBound {
+		http.Error(w, fmt.Sprintf("reserve latency %v exceeds bound %v", latency, c.ReserveLatencyBound), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Action is what a RetryPolicy's NextDelay decides should happen to a job
+// after a worker command has run.
+type Action int
+
+const (
+	// Release puts the job back in the ready queue after the returned
+	// delay.
+	Release Action = iota
+
+	// Bury buries the job so it stops competing for reservation.
+	Bury
+
+	// Delete removes the job entirely.
+	Delete
+
+	// DeadLetter forwards the job to the Broker's DeadLetterTube, falling
+	// back to Bury if none is configured.
+	DeadLetter
+)
+
+func (a Action) String() string {
+	switch a {
+	case Release:
+		return "release"
+	case Bury:
+		return "bury"
+	case Delete:
+		return "delete"
+	case DeadLetter:
+		return "dead-letter"
+	default:
+		return "unknown"
+	}
+}
+
+// RetryPolicy decides what should happen to a job. Exhausted is consulted
+// after a job is reserved and before it is executed, to decide whether it
+// has already retried too many times to bother executing. NextDelay is consulted afterwards, to
+// decide the job's disposition from its exit status.
+type RetryPolicy interface {
+	Exhausted(releases, timeouts int) bool
+	NextDelay(releases, timeouts, exitStatus int) (delay time.Duration, action Action)
+}
+
+// ExponentialPolicy releases a job with a delay that doubles with each
+// release, starting at Base and capped at Cap, burying once releases
+// reaches MaxReleases. MaxReleases of zero means never bury. Jitter, if
+// positive, adds up to that much random variance to the delay so a burst of
+// releases on the same tube doesn't retry in lockstep.
+type ExponentialPolicy struct {
+	Base        time.Duration
+	Cap         time.Duration
+	MaxReleases int
+	Jitter      time.Duration
+}
+
+func (p ExponentialPolicy) Exhausted(releases, timeouts int) bool {
+	return p.MaxReleases > 0 && releases >= p.MaxReleases
+}
+
+func (p ExponentialPolicy) NextDelay(releases, timeouts, exitStatus int) (time.Duration, Action) {
+	if p.MaxReleases > 0 && releases >= p.MaxReleases {
+		return 0, Bury
+	}
+	delay := p.Base << uint(releases)
+	if delay <= 0 || delay > p.Cap {
+		delay = p.Cap
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return delay, Release
+}
+
+// ConstantPolicy always releases a job with the same delay, burying once
+// releases reaches MaxReleases. MaxReleases of zero means never bury.
+type ConstantPolicy struct {
+	Delay       time.Duration
+	MaxReleases int
+}
+
+func (p ConstantPolicy) Exhausted(releases, timeouts int) bool {
+	return p.MaxReleases > 0 && releases >= p.MaxReleases
+}
+
+func (p ConstantPolicy) NextDelay(releases, timeouts, exitStatus int) (time.Duration, Action) {
+	if p.MaxReleases > 0 && releases >= p.MaxReleases {
+		return 0, Bury
+	}
+	return p.Delay, Release
+}
+
+// FibonacciPolicy releases a job with a delay following the Fibonacci
+// sequence scaled by Unit, burying once releases reaches MaxReleases.
+// MaxReleases of zero means never bury.
+type FibonacciPolicy struct {
+	Unit        time.Duration
+	MaxReleases int
+}
+
+func (p FibonacciPolicy) Exhausted(releases, timeouts int) bool {
+	return p.MaxReleases > 0 && releases >= p.MaxReleases
+}
+
+func (p FibonacciPolicy) NextDelay(releases, timeouts, exitStatus int) (time.Duration, Action) {
+	if p.MaxReleases > 0 && releases >= p.MaxReleases {
+		return 0, Bury
+	}
+	return p.Unit * time.Duration(fibonacci(releases+1)), Release
+}
+
+func fibonacci(n int) int {
+	a, b := 0, 1
+	for i := 0; i < n; i++ {
+		a, b = b, a+b
+	}
+	return a
+}
+
+// ExitCodeRule is the action and delay an ExitCodeMapPolicy applies for a
+// specific exit status, e.g. EX_TEMPFAIL (75) releasing after a cool-off.
+type ExitCodeRule struct {
+	Action Action
+	Delay  time.Duration
+}
+
+// ExitCodeMapPolicy looks up the worker's exit status in Codes and applies
+// the matching rule, falling back to Default for any status not listed
+// (and to Bury if there is no Default either).
+type ExitCodeMapPolicy struct {
+	Codes   map[int]ExitCodeRule
+	Default RetryPolicy
+}
+
+// Exhausted has no exit status to look up before a job has run, so it
+// defers to Default (if set); a bare exit-code map never bars a job from
+// running, since every exit status needs an actual execution to produce.
+func (p ExitCodeMapPolicy) Exhausted(releases, timeouts int) bool {
+	if p.Default != nil {
+		return p.Default.Exhausted(releases, timeouts)
+	}
+	return false
+}
+
+func (p ExitCodeMapPolicy) NextDelay(releases, timeouts, exitStatus int) (time.Duration, Action) {
+	if rule, ok := p.Codes[exitStatus]; ok {
+		return rule.Delay, rule.Action
+	}
+	if p.Default != nil {
+		return p.Default.NextDelay(releases, timeouts, exitStatus)
+	}
+	return 0, Bury
+}
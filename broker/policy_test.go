@@ -0,0 +1,136 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialPolicyNextDelay(t *testing.T) {
+	p := ExponentialPolicy{Base: time.Second, Cap: 8 * time.Second, MaxReleases: 4}
+
+	cases := []struct {
+		releases int
+		want     time.Duration
+	}{
+		{0, 1 * time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second}, // would be 8s unscaled, equals Cap
+	}
+	for _, c := range cases {
+		delay, action := p.NextDelay(c.releases, 0, 1)
+		if action != Release {
+			t.Errorf("releases=%d: action = %v, want Release", c.releases, action)
+		}
+		if delay != c.want {
+			t.Errorf("releases=%d: delay = %v, want %v", c.releases, delay, c.want)
+		}
+	}
+
+	if delay, action := p.NextDelay(4, 0, 1); action != Bury || delay != 0 {
+		t.Errorf("at MaxReleases: got (%v, %v), want (0, Bury)", delay, action)
+	}
+}
+
+func TestExponentialPolicyExhausted(t *testing.T) {
+	p := ExponentialPolicy{Base: time.Second, Cap: time.Minute, MaxReleases: 2}
+	if p.Exhausted(1, 0) {
+		t.Error("Exhausted(1, 0) = true, want false")
+	}
+	if !p.Exhausted(2, 0) {
+		t.Error("Exhausted(2, 0) = false, want true")
+	}
+
+	unbounded := ExponentialPolicy{Base: time.Second, Cap: time.Minute}
+	if unbounded.Exhausted(1000, 0) {
+		t.Error("MaxReleases=0 policy should never be exhausted")
+	}
+}
+
+func TestConstantPolicy(t *testing.T) {
+	p := ConstantPolicy{Delay: 5 * time.Second, MaxReleases: 1}
+
+	if delay, action := p.NextDelay(0, 0, 1); delay != 5*time.Second || action != Release {
+		t.Errorf("NextDelay(0,...) = (%v, %v), want (5s, Release)", delay, action)
+	}
+	if delay, action := p.NextDelay(1, 0, 1); action != Bury || delay != 0 {
+		t.Errorf("NextDelay(1,...) = (%v, %v), want (0, Bury)", delay, action)
+	}
+	if !p.Exhausted(1, 0) {
+		t.Error("Exhausted(1, 0) = false, want true")
+	}
+}
+
+func TestFibonacciPolicy(t *testing.T) {
+	p := FibonacciPolicy{Unit: time.Second, MaxReleases: 10}
+
+	cases := []struct {
+		releases int
+		want     time.Duration
+	}{
+		{0, 1 * time.Second},
+		{1, 1 * time.Second},
+		{2, 2 * time.Second},
+		{3, 3 * time.Second},
+		{4, 5 * time.Second},
+	}
+	for _, c := range cases {
+		delay, action := p.NextDelay(c.releases, 0, 1)
+		if action != Release {
+			t.Errorf("releases=%d: action = %v, want Release", c.releases, action)
+		}
+		if delay != c.want {
+			t.Errorf("releases=%d: delay = %v, want %v", c.releases, delay, c.want)
+		}
+	}
+}
+
+func TestExitCodeMapPolicyNextDelay(t *testing.T) {
+	p := ExitCodeMapPolicy{
+		Codes: map[int]ExitCodeRule{
+			75: {Action: Release, Delay: 60 * time.Second},
+			42: {Action: Bury},
+		},
+	}
+
+	if delay, action := p.NextDelay(0, 0, 75); action != Release || delay != 60*time.Second {
+		t.Errorf("exit 75: got (%v, %v), want (60s, Release)", delay, action)
+	}
+	if _, action := p.NextDelay(0, 0, 42); action != Bury {
+		t.Errorf("exit 42: action = %v, want Bury", action)
+	}
+	// An exit status with no matching rule and no Default falls back to Bury.
+	if _, action := p.NextDelay(0, 0, 1); action != Bury {
+		t.Errorf("unmapped exit status: action = %v, want Bury", action)
+	}
+}
+
+func TestExitCodeMapPolicyNextDelayDefault(t *testing.T) {
+	p := ExitCodeMapPolicy{
+		Codes:   map[int]ExitCodeRule{42: {Action: Bury}},
+		Default: ConstantPolicy{Delay: 3 * time.Second},
+	}
+
+	if delay, action := p.NextDelay(0, 0, 1); action != Release || delay != 3*time.Second {
+		t.Errorf("unmapped exit status with Default: got (%v, %v), want (3s, Release)", delay, action)
+	}
+}
+
+// TestExitCodeMapPolicyExhausted guards against the bug where probing
+// NextDelay with a sentinel exit status before a job had run would fall
+// through to the bare "no Default" case and return Bury, burying every job
+// before it got a chance to execute.
+func TestExitCodeMapPolicyExhausted(t *testing.T) {
+	bare := ExitCodeMapPolicy{Codes: map[int]ExitCodeRule{75: {Action: Release}}}
+	if bare.Exhausted(100, 100) {
+		t.Error("a bare exit-code map must never bar a job from running")
+	}
+
+	withDefault := ExitCodeMapPolicy{Default: ConstantPolicy{MaxReleases: 2}}
+	if withDefault.Exhausted(1, 0) {
+		t.Error("Exhausted(1, 0) = true, want false")
+	}
+	if !withDefault.Exhausted(2, 0) {
+		t.Error("Exhausted(2, 0) = false, want true")
+	}
+}
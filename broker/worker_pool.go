@@ -0,0 +1,59 @@
+package broker
+
+import "context"
+
+// WorkerPool caps the number of worker commands that may execute
+// concurrently across every tube a BrokerDispatcher manages, regardless of
+// how many tubes or brokers-per-tube are configured. A tube can be given a
+// heavier weight so its jobs consume more than one slot, leaving fewer
+// slots available for everything else.
+type WorkerPool struct {
+	tokens chan struct{}
+}
+
+// NewWorkerPool creates a pool with the given total capacity. A capacity
+// of zero means unlimited; Acquire and Release become no-ops.
+func NewWorkerPool(capacity uint64) *WorkerPool {
+	if capacity == 0 {
+		return &WorkerPool{}
+	}
+	return &WorkerPool{tokens: make(chan struct{}, capacity)}
+}
+
+// Acquire blocks until weight slots are free, or ctx is cancelled. Any
+// slots already claimed before cancellation are released before Acquire
+// returns the context error.
+func (p *WorkerPool) Acquire(ctx context.Context, weight uint64) error {
+	if p.tokens == nil {
+		return nil
+	}
+	if weight == 0 {
+		weight = 1
+	}
+
+	var claimed uint64
+	for ; claimed < weight; claimed++ {
+		select {
+		case p.tokens <- struct{}{}:
+		case <-ctx.Done():
+			if claimed > 0 {
+				p.Release(claimed)
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Release returns weight slots to the pool.
+func (p *WorkerPool) Release(weight uint64) {
+	if p.tokens == nil {
+		return
+	}
+	if weight == 0 {
+		weight = 1
+	}
+	for i := uint64(0); i < weight; i++ {
+		<-p.tokens
+	}
+}
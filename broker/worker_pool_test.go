@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolUnlimited(t *testing.T) {
+	p := NewWorkerPool(0)
+	if err := p.Acquire(context.Background(), 1000); err != nil {
+		t.Fatalf("Acquire on an unlimited pool returned %v, want nil", err)
+	}
+	p.Release(1000) // must not block or panic
+}
+
+func TestWorkerPoolAcquireRelease(t *testing.T) {
+	p := NewWorkerPool(2)
+	ctx := context.Background()
+
+	if err := p.Acquire(ctx, 2); err != nil {
+		t.Fatalf("Acquire(2) on a 2-slot pool: %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- p.Acquire(ctx, 1) }()
+
+	select {
+	case err := <-acquired:
+		t.Fatalf("Acquire succeeded on a full pool (err=%v), want it to block", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Release(2)
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("Acquire after Release returned %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire never unblocked after Release")
+	}
+	p.Release(1)
+}
+
+// TestWorkerPoolZeroWeightNormalized guards against Acquire and Release
+// disagreeing about what a weight of zero means: both must treat it as 1,
+// or a zero-weight caller could release more slots than it ever claimed.
+func TestWorkerPoolZeroWeightNormalized(t *testing.T) {
+	p := NewWorkerPool(1)
+	ctx := context.Background()
+
+	if err := p.Acquire(ctx, 0); err != nil {
+		t.Fatalf("Acquire(0) on an empty 1-slot pool: %v", err)
+	}
+
+	full := make(chan error, 1)
+	go func() { full <- p.Acquire(ctx, 1) }()
+	select {
+	case err := <-full:
+		t.Fatalf("pool accepted a second acquire after Acquire(0) claimed its only slot (err=%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Release(0)
+
+	select {
+	case err := <-full:
+		if err != nil {
+			t.Fatalf("Acquire after Release(0) returned %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Release(0) did not free the slot claimed by Acquire(0)")
+	}
+	p.Release(1)
+}
+
+func TestWorkerPoolAcquireCancelled(t *testing.T) {
+	p := NewWorkerPool(1)
+	ctx := context.Background()
+	if err := p.Acquire(ctx, 1); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := p.Acquire(cancelCtx, 1); err == nil {
+		t.Fatal("Acquire on an already-cancelled context returned nil error")
+	}
+
+	// The pool must still have exactly its one slot in use: a subsequent
+	// Release of that one slot, then Acquire, must succeed immediately.
+	p.Release(1)
+	done := make(chan error, 1)
+	go func() { done <- p.Acquire(context.Background(), 1) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Acquire after releasing the only claimed slot: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled Acquire leaked a partially-claimed slot")
+	}
+}
@@ -0,0 +1,108 @@
+// Package cli parses cmdstalk's command-line flags into an Options struct.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options holds the parsed configuration for a cmdstalk process.
+type Options struct {
+	Address string
+	Cmd     string
+	PerTube uint64
+	MaxJobs uint64
+	Tubes   []string
+	All     bool
+
+	MaxConcurrent uint64
+	TubeWeights   map[string]uint64
+
+	DeadLetterTube string
+	KickInterval   time.Duration
+	KickMax        int
+
+	ConfigFile string
+
+	MetricsAddr string
+
+	DrainTimeout time.Duration
+}
+
+// tubeWeights implements flag.Value so --tube-weight can be repeated, each
+// occurrence adding one "tube=N" entry.
+type tubeWeights map[string]uint64
+
+func (w tubeWeights) String() string {
+	parts := make([]string, 0, len(w))
+	for tube, weight := range w {
+		parts = append(parts, fmt.Sprintf("%s=%d", tube, weight))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (w tubeWeights) Set(s string) error {
+	tube, rawWeight, ok := strings.Cut(s, "=")
+	if !ok || tube == "" {
+		return fmt.Errorf("--tube-weight must be of the form tube=N, got %q", s)
+	}
+	weight, err := strconv.ParseUint(rawWeight, 10, 64)
+	if err != nil {
+		return fmt.Errorf("--tube-weight %q: %w", s, err)
+	}
+	w[tube] = weight
+	return nil
+}
+
+// MustParseFlags parses os.Args, exiting via log.Fatal on invalid usage.
+func MustParseFlags() Options {
+	var opts Options
+	opts.TubeWeights = make(tubeWeights)
+
+	flag.StringVar(&opts.Address, "address", "127.0.0.1:11300", "beanstalkd address")
+	flag.StringVar(&opts.Cmd, "cmd", "", "worker command to run for each job (required)")
+	flag.Uint64Var(&opts.PerTube, "per-tube", 1, "number of brokers to run per tube")
+	flag.Uint64Var(&opts.MaxJobs, "max-jobs", 0, "stop reserving after this many jobs (0 means unlimited)")
+	flag.BoolVar(&opts.All, "all", false, "watch every tube beanstalkd has, instead of a fixed list")
+
+	flag.Uint64Var(&opts.MaxConcurrent, "max-concurrent", 0, "cap on commands executing at once across all tubes (0 means unlimited)")
+	flag.Var(tubeWeights(opts.TubeWeights), "tube-weight", "tube=N pool weight for a tube's jobs (repeatable, default weight is 1)")
+
+	flag.StringVar(&opts.DeadLetterTube, "dead-letter-tube", "", "tube to forward jobs to once their retries are exhausted")
+	flag.DurationVar(&opts.KickInterval, "kick-interval", 0, "how often to kick buried jobs back into service (0 disables)")
+	flag.IntVar(&opts.KickMax, "kick-max", 10, "maximum number of jobs to kick per tube per --kick-interval tick")
+
+	flag.StringVar(&opts.ConfigFile, "config", "", "YAML file of per-tube retry policies")
+
+	flag.StringVar(&opts.MetricsAddr, "metrics-addr", "", "address to serve /metrics and /healthz on (disabled if empty)")
+
+	flag.DurationVar(&opts.DrainTimeout, "drain-timeout", 30*time.Second, "how long to wait for in-flight jobs on a graceful drain before forcing shutdown")
+
+	flag.Parse()
+
+	if opts.Cmd == "" {
+		fmt.Fprintln(os.Stderr, "cmdstalk: --cmd is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts.Tubes = flag.Args()
+	if !opts.All && len(opts.Tubes) == 0 {
+		fmt.Fprintln(os.Stderr, "cmdstalk: specify one or more tubes, or pass --all")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if opts.ConfigFile != "" {
+		if _, err := os.Stat(opts.ConfigFile); err != nil {
+			log.Fatal("--config: ", err)
+		}
+	}
+
+	return opts
+}
@@ -24,6 +24,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/edo1/cmdstalk/broker"
 	"github.com/edo1/cmdstalk/cli"
@@ -32,16 +34,41 @@ import (
 func main() {
 	opts := cli.MustParseFlags()
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
-	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	ctx := context.Background()
+
+	bd := broker.NewBrokerDispatcher(ctx, opts.Address, opts.Cmd, opts.PerTube, opts.MaxJobs, opts.MaxConcurrent)
+	for tube, weight := range opts.TubeWeights {
+		bd.SetTubeWeight(tube, weight)
+	}
+	bd.DeadLetterTube = opts.DeadLetterTube
+	bd.KickInterval = opts.KickInterval
+	bd.KickMax = opts.KickMax
+
+	if opts.ConfigFile != "" {
+		policies, err := broker.LoadPolicyConfig(opts.ConfigFile)
+		if err != nil {
+			log.Fatal("loading --config: ", err)
+		}
+		for tube, policy := range policies {
+			bd.SetTubePolicy(tube, policy)
+		}
+	}
+
+	if opts.MetricsAddr != "" {
+		bd.EnableMetrics(opts.MetricsAddr, 10*time.Second)
+	}
+
 	go func() {
 		<-c
-		log.Println("received interrupt. quitting.")
-		cancel()
-	}()
+		log.Println("received interrupt, draining (press again to force quit)")
+		go bd.Drain(opts.DrainTimeout)
 
-	bd := broker.NewBrokerDispatcher(ctx, opts.Address, opts.Cmd, opts.PerTube, opts.MaxJobs)
+		<-c
+		log.Println("received second interrupt, terminating in-flight jobs")
+		bd.ForceShutdown()
+	}()
 
 	if opts.All {
 		bd.RunAllTubes()